@@ -0,0 +1,121 @@
+package dcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// 编解码器id,放在pubsub消息里,让订阅者知道该用哪种格式解码payload
+// 为空(0)时按JSON处理,兼容旧版本节点发出的消息
+const (
+	codecIdJSON = iota + 1
+	codecIdMsgpack
+	codecIdProto
+	codecIdGob
+)
+
+// Codec 序列化/反序列化接口,Get/Set默认走JSONCodec,可用WithCodec整体替换或SetWith按次指定
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+	// CodecId 标识该编解码器的格式,随消息一起广播,订阅者据此用同一种格式解码;
+	// 导出是为了让调用方可以实现自己的Codec接入WithCodec/SetWith
+	CodecId() byte
+}
+
+// JSONCodec 默认编解码器,和历史行为保持一致
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error)   { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(b []byte, v interface{}) error { return json.Unmarshal(b, v) }
+func (JSONCodec) CodecId() byte                           { return codecIdJSON }
+
+// MsgpackCodec 二进制紧凑编码,性能优于JSON
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error)   { return msgpack.Marshal(v) }
+func (MsgpackCodec) Unmarshal(b []byte, v interface{}) error { return msgpack.Unmarshal(b, v) }
+func (MsgpackCodec) CodecId() byte                           { return codecIdMsgpack }
+
+// ProtoCodec 用于存取proto.Message,v必须实现proto.Message
+type ProtoCodec struct{}
+
+func (ProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("dcache: ProtoCodec要求v实现proto.Message, 实际类型 %T", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtoCodec) Unmarshal(b []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("dcache: ProtoCodec要求v实现proto.Message, 实际类型 %T", v)
+	}
+	return proto.Unmarshal(b, m)
+}
+
+func (ProtoCodec) CodecId() byte { return codecIdProto }
+
+// GobCodec 适合存time.Time、big.Int等JSON不能原样往返的类型
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if e := gob.NewEncoder(&buf).Encode(v); e != nil {
+		return nil, e
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+func (GobCodec) CodecId() byte { return codecIdGob }
+
+// codecByID 根据pubsub消息里的codec-id还原编解码器,id为0(未携带)时按JSON处理以兼容旧节点
+func codecByID(id byte) Codec {
+	switch id {
+	case codecIdMsgpack:
+		return MsgpackCodec{}
+	case codecIdProto:
+		return ProtoCodec{}
+	case codecIdGob:
+		return GobCodec{}
+	default:
+		return JSONCodec{}
+	}
+}
+
+// WithCodec 替换RedisSession默认使用的编解码器
+func (rs *RedisSession) WithCodec(c Codec) *RedisSession {
+	rs.codec = c
+	return rs
+}
+
+// encodePayload 在编码后的数据前加一个编解码器id字节,解码时据此还原使用的编解码器
+func encodePayload(c Codec, raw []byte) string {
+	buf := make([]byte, 0, len(raw)+1)
+	buf = append(buf, c.CodecId())
+	buf = append(buf, raw...)
+	return string(buf)
+}
+
+// decodePayload 根据首字节还原编解码器并解码;如果首字节不是已知的编解码器id,
+// 说明这是旧版本写入的纯JSON数据,按JSON处理以保证兼容
+func decodePayload(s string, v interface{}) error {
+	if len(s) > 0 {
+		switch s[0] {
+		case codecIdJSON, codecIdMsgpack, codecIdProto, codecIdGob:
+			return codecByID(s[0]).Unmarshal([]byte(s[1:]), v)
+		}
+	}
+	return JSONCodec{}.Unmarshal([]byte(s), v)
+}
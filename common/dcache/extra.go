@@ -0,0 +1,247 @@
+package dcache
+
+import (
+	"fmt"
+
+	"github.com/hqbobo/frame/common/log"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// PFAdd 向HyperLogLog添加元素
+func (rs *RedisSession) PFAdd(key string, els ...interface{}) error {
+	var rsp *redis.IntCmd
+	if rs.cluster {
+		rsp = rs.clusterCLi.PFAdd(ctx, key, els...)
+	} else {
+		rsp = rs.client.PFAdd(ctx, key, els...)
+	}
+	if rsp.Err() != nil {
+		log.Warnf("PFAdd key %s 失败, %s", key, rsp.Err().Error())
+		return rsp.Err()
+	}
+	return nil
+}
+
+// PFCount 估算HyperLogLog的基数
+func (rs *RedisSession) PFCount(keys ...string) int64 {
+	var rsp *redis.IntCmd
+	if rs.cluster {
+		rsp = rs.clusterCLi.PFCount(ctx, keys...)
+	} else {
+		rsp = rs.client.PFCount(ctx, keys...)
+	}
+	if rsp.Err() != nil {
+		log.Warnf("PFCount key %v 失败, %s", keys, rsp.Err().Error())
+		return 0
+	}
+	return rsp.Val()
+}
+
+// PFMerge 合并多个HyperLogLog到dest
+func (rs *RedisSession) PFMerge(dest string, keys ...string) error {
+	var rsp *redis.StatusCmd
+	if rs.cluster {
+		rsp = rs.clusterCLi.PFMerge(ctx, dest, keys...)
+	} else {
+		rsp = rs.client.PFMerge(ctx, dest, keys...)
+	}
+	if rsp.Err() != nil {
+		log.Warnf("PFMerge key %s 失败, %s", dest, rsp.Err().Error())
+		return rsp.Err()
+	}
+	return nil
+}
+
+// SetBit 设置位图某一偏移处的bit值(0或1),成功后通告其它节点清理本地缓存
+func (rs *RedisSession) SetBit(key string, offset int64, value int) error {
+	var rsp *redis.IntCmd
+	if rs.cluster {
+		rsp = rs.clusterCLi.SetBit(ctx, key, offset, value)
+	} else {
+		rsp = rs.client.SetBit(ctx, key, offset, value)
+	}
+	if rsp.Err() != nil {
+		log.Warnf("SetBit key %s 失败, %s", key, rsp.Err().Error())
+		return rsp.Err()
+	}
+	//位图按bit修改,本地无法做增量同步,直接失效整条key
+	if rs.mem != nil {
+		rs.mem.Delete(key)
+	}
+	go rs.publish(key, "", 0, redis_sync_del)
+	return nil
+}
+
+// GetBit 获取位图某一偏移处的bit值
+func (rs *RedisSession) GetBit(key string, offset int64) (int64, error) {
+	var rsp *redis.IntCmd
+	if rs.cluster {
+		rsp = rs.clusterCLi.GetBit(ctx, key, offset)
+	} else {
+		rsp = rs.client.GetBit(ctx, key, offset)
+	}
+	if rsp.Err() != nil {
+		log.Warnf("GetBit key %s 失败, %s", key, rsp.Err().Error())
+		return 0, rsp.Err()
+	}
+	return rsp.Val(), nil
+}
+
+// BitCount 统计位图中置1的bit数,bitRange为nil时统计整个key
+func (rs *RedisSession) BitCount(key string, bitRange *redis.BitCount) (int64, error) {
+	var rsp *redis.IntCmd
+	if rs.cluster {
+		rsp = rs.clusterCLi.BitCount(ctx, key, bitRange)
+	} else {
+		rsp = rs.client.BitCount(ctx, key, bitRange)
+	}
+	if rsp.Err() != nil {
+		log.Warnf("BitCount key %s 失败, %s", key, rsp.Err().Error())
+		return 0, rsp.Err()
+	}
+	return rsp.Val(), nil
+}
+
+// BitOp 对多个位图做AND/OR/XOR/NOT运算,结果写入dest,成功后通告失效dest
+func (rs *RedisSession) BitOp(op, dest string, keys ...string) (int64, error) {
+	if len(keys) == 0 {
+		return 0, fmt.Errorf("dcache: BitOp需要至少一个源key")
+	}
+	var rsp *redis.IntCmd
+	switch op {
+	case "and", "AND":
+		if rs.cluster {
+			rsp = rs.clusterCLi.BitOpAnd(ctx, dest, keys...)
+		} else {
+			rsp = rs.client.BitOpAnd(ctx, dest, keys...)
+		}
+	case "or", "OR":
+		if rs.cluster {
+			rsp = rs.clusterCLi.BitOpOr(ctx, dest, keys...)
+		} else {
+			rsp = rs.client.BitOpOr(ctx, dest, keys...)
+		}
+	case "xor", "XOR":
+		if rs.cluster {
+			rsp = rs.clusterCLi.BitOpXor(ctx, dest, keys...)
+		} else {
+			rsp = rs.client.BitOpXor(ctx, dest, keys...)
+		}
+	case "not", "NOT":
+		//BITOP NOT只接受一个源key,多传的key会被redis-cli忽略,这里直接当成用法错误拒绝
+		if len(keys) != 1 {
+			return 0, fmt.Errorf("dcache: BitOp NOT只支持一个源key, 实际传入%d个", len(keys))
+		}
+		if rs.cluster {
+			rsp = rs.clusterCLi.BitOpNot(ctx, dest, keys[0])
+		} else {
+			rsp = rs.client.BitOpNot(ctx, dest, keys[0])
+		}
+	default:
+		return 0, fmt.Errorf("dcache: BitOp不支持的操作 %s", op)
+	}
+	if rsp.Err() != nil {
+		log.Warnf("BitOp key %s 失败, %s", dest, rsp.Err().Error())
+		return 0, rsp.Err()
+	}
+	if rs.mem != nil {
+		rs.mem.Delete(dest)
+	}
+	go rs.publish(dest, "", 0, redis_sync_del)
+	return rsp.Val(), nil
+}
+
+// BitPos 查找位图中第一个为bit值的位置
+func (rs *RedisSession) BitPos(key string, bit int64, pos ...int64) (int64, error) {
+	var rsp *redis.IntCmd
+	if rs.cluster {
+		rsp = rs.clusterCLi.BitPos(ctx, key, bit, pos...)
+	} else {
+		rsp = rs.client.BitPos(ctx, key, bit, pos...)
+	}
+	if rsp.Err() != nil {
+		log.Warnf("BitPos key %s 失败, %s", key, rsp.Err().Error())
+		return 0, rsp.Err()
+	}
+	return rsp.Val(), nil
+}
+
+// GeoAdd 添加地理位置,成功后通告其它节点清理本地缓存
+func (rs *RedisSession) GeoAdd(key string, geos ...*redis.GeoLocation) (int64, error) {
+	var rsp *redis.IntCmd
+	if rs.cluster {
+		rsp = rs.clusterCLi.GeoAdd(ctx, key, geos...)
+	} else {
+		rsp = rs.client.GeoAdd(ctx, key, geos...)
+	}
+	if rsp.Err() != nil {
+		log.Warnf("GeoAdd key %s 失败, %s", key, rsp.Err().Error())
+		return 0, rsp.Err()
+	}
+	if rs.mem != nil {
+		rs.mem.Delete(key)
+	}
+	go rs.publish(key, "", 0, redis_sync_del)
+	return rsp.Val(), nil
+}
+
+// GeoRadius 按圆形范围查询附近的成员
+func (rs *RedisSession) GeoRadius(key string, longitude, latitude float64, query *redis.GeoRadiusQuery) ([]redis.GeoLocation, error) {
+	var rsp *redis.GeoLocationCmd
+	if rs.cluster {
+		rsp = rs.clusterCLi.GeoRadius(ctx, key, longitude, latitude, query)
+	} else {
+		rsp = rs.client.GeoRadius(ctx, key, longitude, latitude, query)
+	}
+	if rsp.Err() != nil {
+		log.Warnf("GeoRadius key %s 失败, %s", key, rsp.Err().Error())
+		return nil, rsp.Err()
+	}
+	return rsp.Val(), nil
+}
+
+// GeoSearch 按圆形或矩形范围查询附近的成员(新版GEOSEARCH)
+func (rs *RedisSession) GeoSearch(key string, query *redis.GeoSearchQuery) ([]string, error) {
+	var rsp *redis.StringSliceCmd
+	if rs.cluster {
+		rsp = rs.clusterCLi.GeoSearch(ctx, key, query)
+	} else {
+		rsp = rs.client.GeoSearch(ctx, key, query)
+	}
+	if rsp.Err() != nil {
+		log.Warnf("GeoSearch key %s 失败, %s", key, rsp.Err().Error())
+		return nil, rsp.Err()
+	}
+	return rsp.Val(), nil
+}
+
+// GeoDist 计算两个成员之间的距离,unit如m/km/mi/ft
+func (rs *RedisSession) GeoDist(key, member1, member2, unit string) (float64, error) {
+	var rsp *redis.FloatCmd
+	if rs.cluster {
+		rsp = rs.clusterCLi.GeoDist(ctx, key, member1, member2, unit)
+	} else {
+		rsp = rs.client.GeoDist(ctx, key, member1, member2, unit)
+	}
+	if rsp.Err() != nil {
+		log.Warnf("GeoDist key %s 失败, %s", key, rsp.Err().Error())
+		return 0, rsp.Err()
+	}
+	return rsp.Val(), nil
+}
+
+// GeoPos 获取成员的经纬度
+func (rs *RedisSession) GeoPos(key string, members ...string) ([]*redis.GeoPos, error) {
+	var rsp *redis.GeoPosCmd
+	if rs.cluster {
+		rsp = rs.clusterCLi.GeoPos(ctx, key, members...)
+	} else {
+		rsp = rs.client.GeoPos(ctx, key, members...)
+	}
+	if rsp.Err() != nil {
+		log.Warnf("GeoPos key %s 失败, %s", key, rsp.Err().Error())
+		return nil, rsp.Err()
+	}
+	return rsp.Val(), nil
+}
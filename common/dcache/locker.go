@@ -0,0 +1,171 @@
+package dcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/hqbobo/frame/common/log"
+	"github.com/hqbobo/frame/common/utils"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// unlockScript 只有持有者自己的token匹配时才允许删除锁,避免释放掉别人在锁过期后抢到的锁
+var unlockScript = redis.NewScript(`
+if redis.call("get",KEYS[1])==ARGV[1] then
+	return redis.call("del",KEYS[1])
+else
+	return 0
+end
+`)
+
+// renewScript 续约前校验token,只给自己持有的锁续命
+var renewScript = redis.NewScript(`
+if redis.call("get",KEYS[1])==ARGV[1] then
+	return redis.call("pexpire",KEYS[1],ARGV[2])
+else
+	return 0
+end
+`)
+
+// Locker 基于RedisSession实现的分布式互斥锁(Redlock风格单节点版本)
+type Locker struct {
+	rs *RedisSession
+}
+
+// NewLocker 创建一个Locker
+func (rs *RedisSession) NewLocker() *Locker {
+	return &Locker{rs: rs}
+}
+
+// Lock 持有的锁,Unlock/看门狗都靠token认领
+type Lock struct {
+	locker *Locker
+	key    string
+	token  string
+	ttl    time.Duration
+	stopWd chan struct{}
+}
+
+// TryLock 非阻塞加锁,拿不到立刻返回false
+func (l *Locker) TryLock(key string, ttl time.Duration) (*Lock, bool, error) {
+	token := utils.GetRandomString(16)
+	ok, err := l.rs.setNxToken(key, token, ttl)
+	if err != nil {
+		log.Warnln(err.Error())
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	return &Lock{locker: l, key: key, token: token, ttl: ttl}, true, nil
+}
+
+// Lock 阻塞加锁,按LockWithContext的退避间隔重试,直到拿到锁
+func (l *Locker) Lock(key string, ttl time.Duration) (*Lock, error) {
+	return l.LockWithContext(ctx, key, ttl)
+}
+
+// LockWithContext 阻塞加锁,按退避间隔重试,直到拿到锁或ctx被取消
+func (l *Locker) LockWithContext(c context.Context, key string, ttl time.Duration) (*Lock, error) {
+	wait := 20 * time.Millisecond
+	const maxWait = 200 * time.Millisecond
+	for {
+		lk, ok, err := l.TryLock(key, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return lk, nil
+		}
+		select {
+		case <-c.Done():
+			return nil, c.Err()
+		case <-time.After(wait):
+		}
+		if wait < maxWait {
+			wait *= 2
+			if wait > maxWait {
+				wait = maxWait
+			}
+		}
+	}
+}
+
+// WithWatchdog 启动一个续约协程,每TTL/3续命一次,直到Unlock被调用
+func (l *Lock) WithWatchdog() *Lock {
+	if l.stopWd != nil {
+		return l
+	}
+	l.stopWd = make(chan struct{})
+	go l.watchdog()
+	return l
+}
+
+func (l *Lock) watchdog() {
+	interval := l.ttl / 3
+	if interval <= 0 {
+		interval = time.Millisecond * 100
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stopWd:
+			return
+		case <-t.C:
+			if err := l.locker.rs.renewToken(l.key, l.token, l.ttl); err != nil {
+				log.Warnln(err.Error())
+			}
+		}
+	}
+}
+
+// Unlock 释放锁,只有token匹配(仍是本次持有者)才会真正删除
+func (l *Lock) Unlock() error {
+	if l.stopWd != nil {
+		close(l.stopWd)
+		l.stopWd = nil
+	}
+	ok, err := l.locker.rs.unlockToken(l.key, l.token)
+	if err != nil {
+		log.Warnln(err.Error())
+		return err
+	}
+	if ok {
+		//通告其它节点清理本地锁相关缓存
+		go l.locker.rs.publish(l.key, l.token, 0, redis_sync_del)
+	}
+	return nil
+}
+
+func (rs *RedisSession) setNxToken(key, token string, ttl time.Duration) (bool, error) {
+	if rs.cluster {
+		return rs.clusterCLi.SetNX(ctx, key, token, ttl).Result()
+	}
+	return rs.client.SetNX(ctx, key, token, ttl).Result()
+}
+
+func (rs *RedisSession) unlockToken(key, token string) (bool, error) {
+	var res *redis.Cmd
+	if rs.cluster {
+		res = unlockScript.Run(ctx, rs.clusterCLi, []string{key}, token)
+	} else {
+		res = unlockScript.Run(ctx, rs.client, []string{key}, token)
+	}
+	if res.Err() != nil {
+		return false, res.Err()
+	}
+	n, _ := res.Result()
+	return n == int64(1), nil
+}
+
+func (rs *RedisSession) renewToken(key, token string, ttl time.Duration) error {
+	var res *redis.Cmd
+	if rs.cluster {
+		res = renewScript.Run(ctx, rs.clusterCLi, []string{key}, token, ttl.Milliseconds())
+	} else {
+		res = renewScript.Run(ctx, rs.client, []string{key}, token, ttl.Milliseconds())
+	}
+	return res.Err()
+}
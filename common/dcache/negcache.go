@@ -0,0 +1,43 @@
+package dcache
+
+import (
+	"github.com/hqbobo/frame/common/log"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// negativeCacheValue 不存在的key在mem里缓存的哨兵值;首字节0既不是json的起始字符也不是任何Codec的id,不会和真实payload混淆
+const negativeCacheValue = "\x00"
+
+// default_negative_ttl 未配置时"不存在"结果在mem里的缓存时长(秒)
+const default_negative_ttl = 3
+
+// WithNegativeTTL 设置"key不存在"这一结果在mem里的缓存时长,用于抑制对不存在key的穿透
+func (rs *RedisSession) WithNegativeTTL(seconds int) *RedisSession {
+	rs.negTtl = seconds
+	return rs
+}
+
+// loadFromRedis 从redis加载一个key,如果不存在则写入一个短TTL的哨兵值,避免反复穿透redis
+func (rs *RedisSession) loadFromRedis(key string) (string, error) {
+	var str *redis.StringCmd
+	if rs.cluster {
+		str = rs.clusterCLi.Get(ctx, key)
+	} else {
+		str = rs.client.Get(ctx, key)
+	}
+	if str.Err() != nil {
+		if str.Err() == redis.Nil {
+			rs.mem.Set(key, negativeCacheValue, rs.negTtl)
+			return negativeCacheValue, nil
+		}
+		log.Warnf("获取key %s 失败, %s", key, str.Err().Error())
+		return "", str.Err()
+	}
+	s := str.Val()
+	if ttl, ok := rs.getTtl(key); ok {
+		//内存提前5秒超时
+		rs.mem.Set(key, s, ttl-5)
+	}
+	return s, nil
+}
@@ -0,0 +1,135 @@
+package dcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/hqbobo/frame/common/log"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Tx 即go-redis的事务句柄,Watch回调中用它读取被watch的key并提交管道
+type Tx = redis.Tx
+
+// Pipeline 批量命令管道,用于把多条命令合并成一次往返
+type Pipeline struct {
+	rs   *RedisSession
+	pipe redis.Pipeliner
+}
+
+// Pipeline 返回一个非事务性的管道,命令在Exec时一次性发出
+func (rs *RedisSession) Pipeline() *Pipeline {
+	var pipe redis.Pipeliner
+	if rs.cluster {
+		pipe = rs.clusterCLi.Pipeline()
+	} else {
+		pipe = rs.client.Pipeline()
+	}
+	return &Pipeline{rs: rs, pipe: pipe}
+}
+
+// TxPipeline 返回一个事务性(MULTI/EXEC)的管道
+func (rs *RedisSession) TxPipeline() *Pipeline {
+	var pipe redis.Pipeliner
+	if rs.cluster {
+		pipe = rs.clusterCLi.TxPipeline()
+	} else {
+		pipe = rs.client.TxPipeline()
+	}
+	return &Pipeline{rs: rs, pipe: pipe}
+}
+
+// Set 和RedisSession.Set一样走会话当前的编解码器,保证管道写入和其它写入路径的编码格式一致
+func (p *Pipeline) Set(key string, data interface{}, ttl int) error {
+	codec := p.rs.codec
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	b, e := codec.Marshal(data)
+	if e != nil {
+		log.Warnln(e.Error())
+		return e
+	}
+	if ttl <= 0 {
+		ttl = redis_item_timeout
+	}
+	p.pipe.Set(ctx, key, encodePayload(codec, b), time.Second*time.Duration(ttl))
+	return nil
+}
+
+func (p *Pipeline) Get(key string) *redis.StringCmd {
+	return p.pipe.Get(ctx, key)
+}
+
+func (p *Pipeline) HSet(key, field, data string) *redis.IntCmd {
+	return p.pipe.HSet(ctx, key, field, data)
+}
+
+func (p *Pipeline) HGet(key, field string) *redis.StringCmd {
+	return p.pipe.HGet(ctx, key, field)
+}
+
+func (p *Pipeline) ZAdd(key string, score float64, member interface{}) *redis.IntCmd {
+	return p.pipe.ZAdd(ctx, key, &redis.Z{Score: score, Member: member})
+}
+
+func (p *Pipeline) Incr(key string) *redis.IntCmd {
+	return p.pipe.Incr(ctx, key)
+}
+
+func (p *Pipeline) Delete(key string) *redis.IntCmd {
+	return p.pipe.Del(ctx, key)
+}
+
+// Exec 提交管道中的所有命令;集群模式下go-redis会按key所在的slot自动拆分并路由
+// 非事务管道即使部分命令出错,其它命令仍会被执行,所以invalidation要基于每条命令自己的
+// 执行结果来发,不能因为Exec整体返回了error就跳过那些已经成功写入的命令
+func (p *Pipeline) Exec() ([]redis.Cmder, error) {
+	cmds, e := p.pipe.Exec(ctx)
+	if e != nil && e != redis.Nil {
+		log.Warnln(e.Error())
+	}
+	for _, c := range cmds {
+		if c.Err() != nil {
+			continue
+		}
+		args := c.Args()
+		if len(args) < 2 {
+			continue
+		}
+		name, _ := args[0].(string)
+		key, _ := args[1].(string)
+		switch name {
+		case "set", "hset", "zadd", "incr", "incrby", "del":
+			if p.rs.mem != nil {
+				p.rs.mem.Delete(key)
+			}
+			go p.rs.publish(key, "", 0, redis_sync_del)
+		}
+	}
+	return cmds, e
+}
+
+// Watch 基于WATCH/MULTI/EXEC实现乐观锁读改写,fn内通过tx读取watch的key并提交管道
+// 遇到redis.TxFailedErr(被watch的key在提交前发生变化)时自动重试
+func (rs *RedisSession) Watch(c context.Context, fn func(tx *Tx) error, keys ...string) error {
+	const maxRetries = 10
+	for i := 0; i < maxRetries; i++ {
+		var err error
+		if rs.cluster {
+			err = rs.clusterCLi.Watch(c, fn, keys...)
+		} else {
+			err = rs.client.Watch(c, fn, keys...)
+		}
+		if err == nil {
+			return nil
+		}
+		if err == redis.TxFailedErr {
+			continue
+		}
+		log.Warnln(err.Error())
+		return err
+	}
+	return redis.TxFailedErr
+}
@@ -2,28 +2,35 @@ package dcache
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"sync"
 	"time"
 
 	"github.com/hqbobo/frame/common/log"
 	"github.com/hqbobo/frame/common/utils"
 
 	"github.com/go-redis/redis/v8"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
-	redis_item_timeout = 60 * 60
-	redis_sync_chan    = "dcach_sync"
-	redis_sync_set     = 1
-	redis_sync_del     = 2
+	redis_item_timeout   = 60 * 60
+	redis_sync_chan      = "dcach_sync"
+	redis_sync_set       = 1
+	redis_sync_del       = 2
+	redis_sync_heartbeat = 3
 )
 
 type publisher struct {
-	From string
-	Act  int
-	Key  string
-	Val  string
-	Ttl  int
+	From      string
+	Act       int
+	Key       string
+	Val       string
+	Ttl       int
+	CodecId   byte
+	Version   uint64
+	Timestamp int64
 }
 
 type RedisSession struct {
@@ -34,6 +41,16 @@ type RedisSession struct {
 	name       string
 	mem        *MemSession
 	cluster    bool
+	codec      Codec
+	version    uint64
+	pubMu      sync.Mutex
+	seenVerMu  sync.Mutex
+	seenVer    map[string]uint64
+	hbVerMu    sync.Mutex
+	hbVer      map[string]uint64
+	metrics    syncMetrics
+	sf         singleflight.Group
+	negTtl     int
 }
 
 func newRedis(ip string, pass string) *RedisSession {
@@ -48,7 +65,12 @@ func newRedis(ip string, pass string) *RedisSession {
 	})
 	s.cluster = false
 	s.mem = newMemSession()
+	s.codec = JSONCodec{}
+	s.seenVer = make(map[string]uint64)
+	s.hbVer = make(map[string]uint64)
+	s.negTtl = default_negative_ttl
 	go s.subscribe()
+	go s.heartbeatLoop()
 	return s
 }
 
@@ -62,48 +84,42 @@ func newRedisCluster(ip []string, pass string) *RedisSession {
 	})
 	s.cluster = true
 	s.mem = newMemSession()
+	s.codec = JSONCodec{}
+	s.seenVer = make(map[string]uint64)
+	s.hbVer = make(map[string]uint64)
+	s.negTtl = default_negative_ttl
 	go s.subscribe()
+	go s.heartbeatLoop()
 	return s
 }
 
 var ctx = context.Background()
 
-//监听数据修改事件
-func (rs *RedisSession) subscribe() {
-	var sub *redis.PubSub
-	if rs.cluster {
-		sub = rs.clusterCLi.Subscribe(ctx, redis_sync_chan)
-	} else {
-		sub = rs.client.Subscribe(ctx, redis_sync_chan)
-	}
-	defer sub.Close()
-	var pub publisher
-	chn := sub.Channel()
-	for msg := range chn {
-		if e := json.Unmarshal([]byte(msg.Payload), &pub); e == nil {
-			if pub.From != rs.name {
-				if pub.From != rs.name {
-					if pub.Act == redis_sync_set {
-						rs.mem.Set(pub.Key, pub.Val, pub.Ttl)
-					} else if pub.Act == redis_sync_del {
-						rs.mem.Delete(pub.Key)
-					}
-				}
-			}
-		} else {
-			log.Warnln(e.Error())
-		}
-	}
-}
-
 //消息推送
 func (rs *RedisSession) publish(key, val string, ttl int, act int) {
+	rs.publishCodec(key, val, ttl, act, 0)
+}
+
+//消息推送,携带编解码器id,便于订阅方用同一种格式解码Val
+//每次调用都是独立的goroutine(见Set/Delete里的go rs.publish...),如果版本号和真正的Publish不在
+//同一把锁里,版本号更大的消息完全可能先一步到达redis,peer端就会把版本号更小、但其实更新的消息当成乱序丢弃。
+//所以这里要把"领版本号"和"发到redis"锁在一起,保证线序和版本序一致
+func (rs *RedisSession) publishCodec(key, val string, ttl int, act int, codecId byte) {
+	rs.pubMu.Lock()
+	defer rs.pubMu.Unlock()
+
 	p := new(publisher)
 	p.Key = key
-	p.Val = val
+	//Val可能是Msgpack/Proto/Gob编码后的二进制数据,不是合法UTF-8;
+	//直接塞进JSON会被encoding/json用U+FFFD替换掉非法字节,所以先base64编码再装envelope
+	p.Val = base64.StdEncoding.EncodeToString([]byte(val))
 	p.Ttl = ttl
 	p.Act = act
 	p.From = rs.name
+	p.CodecId = codecId
+	rs.version++
+	p.Version = rs.version
+	p.Timestamp = time.Now().Unix()
 
 	//转为字符串
 	s, e := json.Marshal(p)
@@ -157,30 +173,27 @@ func (rs *RedisSession) HDel(key, field string) error {
 func (rs *RedisSession) Get(key string, data interface{}) bool {
 	var s string
 	if !rs.mem.Get(key, &s) {
-		var str *redis.StringCmd
-		if rs.cluster {
-			str = rs.clusterCLi.Get(ctx, key)
-		} else {
-			str = rs.client.Get(ctx, key)
+		//同一个未命中的key只让一个goroutine真正打redis,其余等待共享结果,避免缓存击穿
+		v, e, _ := rs.sf.Do(key, func() (interface{}, error) {
+			return rs.loadFromRedis(key)
+		})
+		if e != nil {
+			return false
 		}
-		if str.Err() != nil {
-			log.Warnf("获取key %s 失败, %s", key, str.Err().Error())
+		s = v.(string)
+		if s == negativeCacheValue {
 			return false
 		}
-		s = str.Val()
-
-		if ttl, ok := rs.getTtl(key); ok {
-			// log.Debugf("load: %s ttl[ %d ] from redis:", str.Val(), ttl)
-			if e := json.Unmarshal([]byte(str.Val()), data); e != nil {
-				log.Warnln(e.Error())
-				return false
-			}
-			//内存提前5秒超时
-			return rs.mem.Set(key, s, ttl-5)
+		if e := decodePayload(s, data); e != nil {
+			log.Warnln(e.Error())
+			return false
 		}
+		return true
+	}
+	if s == negativeCacheValue {
 		return false
 	}
-	if e := json.Unmarshal([]byte(s), data); e != nil {
+	if e := decodePayload(s, data); e != nil {
 		log.Warnln("%s - %s ", s, e.Error())
 		return false
 	}
@@ -188,13 +201,22 @@ func (rs *RedisSession) Get(key string, data interface{}) bool {
 }
 
 func (rs *RedisSession) Set(key string, data interface{}, ttl int) bool {
+	return rs.SetWith(key, data, ttl, rs.codec)
+}
+
+// SetWith 和Set一样,但显式指定本次存取用的编解码器,不受WithCodec设置的默认值影响
+func (rs *RedisSession) SetWith(key string, data interface{}, ttl int, codec Codec) bool {
 	var rsp *redis.StatusCmd
+	if codec == nil {
+		codec = JSONCodec{}
+	}
 	//转为字符串
-	s, e := json.Marshal(data)
+	b, e := codec.Marshal(data)
 	if e != nil {
 		log.Warnln(e.Error())
 		return false
 	}
+	s := encodePayload(codec, b)
 	//必须配置超时
 	if ttl <= 0 {
 		ttl = redis_item_timeout
@@ -209,10 +231,10 @@ func (rs *RedisSession) Set(key string, data interface{}, ttl int) bool {
 	} else {
 		//缓存本地
 		if rs.mem != nil {
-			rs.mem.Set(key, string(s), ttl)
+			rs.mem.Set(key, s, ttl)
 		}
 		//通告修改
-		go rs.publish(key, string(s), ttl, redis_sync_set)
+		go rs.publishCodec(key, s, ttl, redis_sync_set, codec.CodecId())
 		return true
 	}
 	return false
@@ -0,0 +1,167 @@
+package dcache
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/hqbobo/frame/common/log"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	redis_sync_heartbeat_interval = 10 * time.Second
+	redis_sync_backoff_min        = time.Second
+	redis_sync_backoff_max        = 30 * time.Second
+)
+
+// syncMetrics 同步层的可观测指标,供Metrics()对外暴露
+type syncMetrics struct {
+	received   int64
+	dropped    int64
+	outOfOrder int64
+	reconnects int64
+}
+
+// SyncMetrics 是syncMetrics的只读快照
+type SyncMetrics struct {
+	Received   int64
+	Dropped    int64
+	OutOfOrder int64
+	Reconnects int64
+}
+
+// Metrics 返回当前的同步层统计信息,用于监控订阅链路是否健康
+func (rs *RedisSession) Metrics() SyncMetrics {
+	return SyncMetrics{
+		Received:   atomic.LoadInt64(&rs.metrics.received),
+		Dropped:    atomic.LoadInt64(&rs.metrics.dropped),
+		OutOfOrder: atomic.LoadInt64(&rs.metrics.outOfOrder),
+		Reconnects: atomic.LoadInt64(&rs.metrics.reconnects),
+	}
+}
+
+//监听数据修改事件;channel断开后按指数退避重连,并在重连后丢弃本地可能过期的L1缓存
+func (rs *RedisSession) subscribe() {
+	backoff := redis_sync_backoff_min
+	reconnecting := false
+	for {
+		if reconnecting {
+			time.Sleep(backoff)
+			if backoff < redis_sync_backoff_max {
+				backoff *= 2
+				if backoff > redis_sync_backoff_max {
+					backoff = redis_sync_backoff_max
+				}
+			}
+			atomic.AddInt64(&rs.metrics.reconnects, 1)
+			rs.requestResync()
+		}
+		start := time.Now()
+		rs.subscribeOnce()
+		reconnecting = true
+		//只有这一轮连接撑过了最大退避时长,才认为网络已经恢复正常,把退避重置回最小值;
+		//否则(比如连上又立刻断开)继续沿用翻倍后的backoff,不然"指数退避"会被每次重置打回原形
+		if time.Since(start) >= redis_sync_backoff_max {
+			backoff = redis_sync_backoff_min
+		}
+	}
+}
+
+//subscribeOnce 订阅一轮,直到channel关闭(连接断开)才返回,交由subscribe负责重连
+func (rs *RedisSession) subscribeOnce() {
+	var sub *redis.PubSub
+	if rs.cluster {
+		sub = rs.clusterCLi.Subscribe(ctx, redis_sync_chan)
+	} else {
+		sub = rs.client.Subscribe(ctx, redis_sync_chan)
+	}
+	defer sub.Close()
+	chn := sub.Channel()
+	for msg := range chn {
+		rs.handleSyncMessage(msg.Payload)
+	}
+}
+
+func (rs *RedisSession) handleSyncMessage(payload string) {
+	var pub publisher
+	if e := json.Unmarshal([]byte(payload), &pub); e != nil {
+		log.Warnln(e.Error())
+		return
+	}
+	if pub.From == rs.name {
+		return
+	}
+	atomic.AddInt64(&rs.metrics.received, 1)
+
+	switch pub.Act {
+	case redis_sync_heartbeat:
+		//心跳只把对端最新的心跳版本号记到独立的水位hbVer里(本包内没有代码读取它做存活/gap判断);
+		//不能更新seenVer,否则心跳的版本号会抢在迟到的SET/DEL前面,把真正的数据更新当成"乱序"丢掉
+		rs.bumpHeartbeatVersion(pub.From, pub.Version)
+	case redis_sync_set, redis_sync_del:
+		if !rs.checkInOrder(pub.From, pub.Version) {
+			atomic.AddInt64(&rs.metrics.outOfOrder, 1)
+			atomic.AddInt64(&rs.metrics.dropped, 1)
+			return
+		}
+		if pub.Act == redis_sync_set {
+			//旧版本节点不携带CodecId,Val是未经base64的JSON原文,原样写入本地缓存,Get时按JSON解码
+			if pub.CodecId == 0 {
+				rs.mem.Set(pub.Key, pub.Val, pub.Ttl)
+				return
+			}
+			raw, e := base64.StdEncoding.DecodeString(pub.Val)
+			if e != nil {
+				log.Warnln(e.Error())
+				return
+			}
+			//payload首字节本就是编解码器id,这里用发布方显式携带的CodecId校验一致性,
+			//不一致说明两端对payload格式的理解对不上,不写入本地缓存以免Get时解码出错
+			if len(raw) == 0 || raw[0] != pub.CodecId {
+				log.Warnf("dcache: key %s 的codec-id不匹配, 期望 %d", pub.Key, pub.CodecId)
+				return
+			}
+			rs.mem.Set(pub.Key, string(raw), pub.Ttl)
+		} else {
+			rs.mem.Delete(pub.Key)
+		}
+	}
+}
+
+//checkInOrder 按来源节点维护单调递增的版本号,版本号不大于已见过的值说明消息迟到或乱序,直接丢弃
+func (rs *RedisSession) checkInOrder(from string, version uint64) bool {
+	rs.seenVerMu.Lock()
+	defer rs.seenVerMu.Unlock()
+	if version != 0 && version <= rs.seenVer[from] {
+		return false
+	}
+	rs.seenVer[from] = version
+	return true
+}
+
+//bumpHeartbeatVersion 维护心跳自己的版本水位,和checkInOrder使用的seenVer相互独立;本包内没有读取该水位做存活/gap检测的代码
+func (rs *RedisSession) bumpHeartbeatVersion(from string, version uint64) {
+	rs.hbVerMu.Lock()
+	defer rs.hbVerMu.Unlock()
+	if version > rs.hbVer[from] {
+		rs.hbVer[from] = version
+	}
+}
+
+//heartbeatLoop 周期性广播心跳;接收方只记录心跳版本号,不据此判断断线/静默
+func (rs *RedisSession) heartbeatLoop() {
+	t := time.NewTicker(redis_sync_heartbeat_interval)
+	defer t.Stop()
+	for range t.C {
+		rs.publish("", "", 0, redis_sync_heartbeat)
+	}
+}
+
+//requestResync 重连后只清空自己的L1缓存,下一次Get会穿透到redis拿到最新值;
+//不向其它节点广播,避免一次本地网络抖动被放大成全员缓存雪崩
+func (rs *RedisSession) requestResync() {
+	rs.mem.Flush()
+}